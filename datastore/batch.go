@@ -0,0 +1,189 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxMutationsPerCommit is the maximum number of mutations the Datastore
+	// service accepts in a single Commit request.
+	maxMutationsPerCommit = 500
+
+	// maxCommitRequestBytes is the maximum serialized size this client will
+	// let a single Commit request grow to. It is kept under the service's
+	// ~10 MiB limit to leave headroom for request framing overhead.
+	maxCommitRequestBytes = 9 << 20 // 9 MiB
+
+	// maxKeysPerLookup is the maximum number of keys the Datastore service
+	// accepts in a single Lookup request, used to batch GetMulti.
+	maxKeysPerLookup = 1000
+
+	// defaultBatchParallelism is the number of sub-batches dispatched
+	// concurrently by commitInBatches when BatchOptions doesn't specify one.
+	defaultBatchParallelism = 10
+)
+
+// BatchOptions controls how a MutateBatch or GetMultiBatch call whose input
+// exceeds the Datastore service's per-request limits is split into multiple
+// RPCs under the hood. Mutate, PutMulti, DeleteMulti, and GetMulti take no
+// BatchOptions and always use the defaults.
+type BatchOptions struct {
+	// MaxParallel is the maximum number of sub-batch RPCs dispatched
+	// concurrently. If zero, defaultBatchParallelism is used. It has no
+	// effect inside a transaction, where a call that exceeds the limit
+	// fails fast instead of being split, since a transaction's mutations
+	// must all be applied in a single Commit.
+	MaxParallel int
+}
+
+func (o *BatchOptions) maxParallel() int {
+	if o == nil || o.MaxParallel <= 0 {
+		return defaultBatchParallelism
+	}
+	return o.MaxParallel
+}
+
+// splitMutations splits protos into the fewest ordered sub-slices such that
+// each sub-slice has at most maxMutationsPerCommit elements and a combined
+// serialized size of at most maxCommitRequestBytes, except that a single
+// mutation larger than maxCommitRequestBytes gets a sub-slice of its own,
+// which then exceeds that size. The relative order of
+// protos is preserved, so callers can recover the original index of any
+// mutation in a sub-batch from its offset.
+func splitMutations(protos []*pb.Mutation) [][]*pb.Mutation {
+	if len(protos) == 0 {
+		return nil
+	}
+	var batches [][]*pb.Mutation
+	start, size := 0, 0
+	for i, p := range protos {
+		pSize := proto.Size(p)
+		tooManyMutations := i-start >= maxMutationsPerCommit
+		tooManyBytes := i > start && size+pSize > maxCommitRequestBytes
+		if tooManyMutations || tooManyBytes {
+			batches = append(batches, protos[start:i])
+			start, size = i, 0
+		}
+		size += pSize
+	}
+	return append(batches, protos[start:])
+}
+
+// commitFunc issues a single Commit (or equivalent) RPC for a sub-batch of
+// mutations and returns one *pb.MutationResult per mutation, positionally
+// aligned with the input. start is the sub-batch's offset into the original,
+// unsplit proto slice, which Client.Mutate, PutMulti, and DeleteMulti use to
+// look up the *Key a failing mutation in the sub-batch belongs to (see
+// Client.conflictError). Client.Mutate, PutMulti, and DeleteMulti supply a
+// commitFunc bound to their transaction (or lack of one).
+type commitFunc func(ctx context.Context, start int, sub []*pb.Mutation) ([]*pb.MutationResult, error)
+
+// commitInBatches splits protos into sub-batches honoring the Datastore
+// mutation-count and request-size limits, then dispatches them with commit.
+//
+// Inside a transaction, protos is never split: all of a transaction's
+// mutations must be applied in a single Commit, so a batch that would need
+// splitting is reported as an error instead. Outside a transaction,
+// sub-batches are committed concurrently, bounded by opts.MaxParallel, and
+// their results are merged back into a single slice of *pb.MutationResult
+// that stays positionally aligned with protos, so callers can still map
+// results back to the *Key, *PendingKey, or error for a given input mutation.
+//
+// When protos fits in a single commit, it is passed to commit as is and
+// commit's results and error are returned unchanged. Otherwise, if one or
+// more sub-batches fail, the other sub-batches still run to
+// completion, and the returned error is a MultiError with one entry per
+// element of protos: nil for mutations whose sub-batch succeeded, and the
+// sub-batch's error (or the corresponding element of a MultiError) for the
+// rest.
+func commitInBatches(ctx context.Context, protos []*pb.Mutation, inTransaction bool, opts *BatchOptions, commit commitFunc) ([]*pb.MutationResult, error) {
+	batches := splitMutations(protos)
+	if len(batches) <= 1 {
+		return commit(ctx, 0, protos)
+	}
+	if inTransaction {
+		return nil, fmt.Errorf("datastore: transaction has %d mutations, which exceeds the %d mutation / %d byte commit limit and cannot be split across multiple commits",
+			len(protos), maxMutationsPerCommit, maxCommitRequestBytes)
+	}
+
+	results := make([]*pb.MutationResult, len(protos))
+	merr := make(MultiError, len(protos))
+	var hasErr bool
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.maxParallel())
+
+	offset := 0
+	for _, batch := range batches {
+		batch, start := batch, offset
+		offset += len(batch)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res, err := commit(ctx, start, batch)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				copy(results[start:], res)
+				return
+			}
+			hasErr = true
+			if batchMerr, ok := err.(MultiError); ok {
+				copy(merr[start:], batchMerr)
+				return
+			}
+			for i := range batch {
+				merr[start+i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	if hasErr {
+		return results, merr
+	}
+	return results, nil
+}
+
+// splitKeyRanges splits a slice of n keys into the fewest ordered [start, end)
+// index ranges such that each range spans at most maxKeysPerLookup keys. It's
+// used to batch GetMulti's Lookup RPCs, which have no separate byte-size
+// limit to account for the way Commit does.
+func splitKeyRanges(n int) [][2]int {
+	if n == 0 {
+		return nil
+	}
+	var ranges [][2]int
+	for start := 0; start < n; start += maxKeysPerLookup {
+		end := start + maxKeysPerLookup
+		if end > n {
+			end = n
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+)
+
+func mutationProtoOfSize(t *testing.T, n int) *pb.Mutation {
+	t.Helper()
+	return &pb.Mutation{
+		Operation: &pb.Mutation_Upsert{
+			Upsert: &pb.Entity{
+				Key: &pb.Key{Path: []*pb.Key_PathElement{{
+					Kind:   "Gopher",
+					IdType: &pb.Key_PathElement_Name{Name: string(make([]byte, n))},
+				}}},
+			},
+		},
+	}
+}
+
+func TestSplitMutationsByCount(t *testing.T) {
+	protos := make([]*pb.Mutation, maxMutationsPerCommit+1)
+	for i := range protos {
+		protos[i] = mutationProtoOfSize(t, 1)
+	}
+	batches := splitMutations(protos)
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+	if len(batches[0]) != maxMutationsPerCommit {
+		t.Errorf("first batch has %d mutations, want %d", len(batches[0]), maxMutationsPerCommit)
+	}
+	if len(batches[1]) != 1 {
+		t.Errorf("second batch has %d mutations, want 1", len(batches[1]))
+	}
+}
+
+func TestSplitMutationsByByteSize(t *testing.T) {
+	protos := []*pb.Mutation{
+		mutationProtoOfSize(t, maxCommitRequestBytes/2),
+		mutationProtoOfSize(t, maxCommitRequestBytes/2),
+		mutationProtoOfSize(t, 10),
+	}
+	batches := splitMutations(protos)
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+	if len(batches[0]) != 1 || len(batches[1]) != 2 {
+		t.Errorf("got batch sizes %d and %d, want 1 and 2", len(batches[0]), len(batches[1]))
+	}
+}
+
+func TestCommitInBatchesMergesResultsInOrder(t *testing.T) {
+	n := maxMutationsPerCommit*2 + 5
+	protos := make([]*pb.Mutation, n)
+	for i := range protos {
+		protos[i] = mutationProtoOfSize(t, 1)
+	}
+
+	var calls int32
+	commit := func(ctx context.Context, start int, sub []*pb.Mutation) ([]*pb.MutationResult, error) {
+		atomic.AddInt32(&calls, 1)
+		res := make([]*pb.MutationResult, len(sub))
+		for i := range sub {
+			res[i] = &pb.MutationResult{Version: int64(start + i)}
+		}
+		return res, nil
+	}
+
+	results, err := commitInBatches(context.Background(), protos, false, nil, commit)
+	if err != nil {
+		t.Fatalf("commitInBatches: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("commit called %d times, want 3", got)
+	}
+	for i, res := range results {
+		if res == nil || res.Version != int64(i) {
+			t.Fatalf("results[%d] = %v, want Version %d", i, res, i)
+		}
+	}
+}
+
+func TestCommitInBatchesPartialFailure(t *testing.T) {
+	n := maxMutationsPerCommit + 1
+	protos := make([]*pb.Mutation, n)
+	for i := range protos {
+		protos[i] = mutationProtoOfSize(t, 1)
+	}
+	wantErr := errors.New("boom")
+
+	commit := func(ctx context.Context, start int, sub []*pb.Mutation) ([]*pb.MutationResult, error) {
+		if start == 0 {
+			return nil, wantErr
+		}
+		res := make([]*pb.MutationResult, len(sub))
+		for i := range sub {
+			res[i] = &pb.MutationResult{}
+		}
+		return res, nil
+	}
+
+	_, err := commitInBatches(context.Background(), protos, false, nil, commit)
+	merr, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("got error of type %T, want MultiError", err)
+	}
+	if len(merr) != n {
+		t.Fatalf("got %d errors, want %d", len(merr), n)
+	}
+	for i := 0; i < maxMutationsPerCommit; i++ {
+		if merr[i] != wantErr {
+			t.Errorf("merr[%d] = %v, want %v", i, merr[i], wantErr)
+		}
+	}
+	if merr[n-1] != nil {
+		t.Errorf("merr[%d] = %v, want nil", n-1, merr[n-1])
+	}
+}
+
+func TestCommitInBatchesTransactionFailsFastWhenOversized(t *testing.T) {
+	protos := make([]*pb.Mutation, maxMutationsPerCommit+1)
+	for i := range protos {
+		protos[i] = mutationProtoOfSize(t, 1)
+	}
+
+	called := false
+	commit := func(ctx context.Context, start int, sub []*pb.Mutation) ([]*pb.MutationResult, error) {
+		called = true
+		return nil, nil
+	}
+
+	_, err := commitInBatches(context.Background(), protos, true, nil, commit)
+	if err == nil {
+		t.Fatal("commitInBatches: got nil error, want an error about the oversized transaction")
+	}
+	if called {
+		t.Error("commit was called for an oversized transactional batch, want fail-fast with no RPC")
+	}
+}
+
+func TestSplitKeyRanges(t *testing.T) {
+	ranges := splitKeyRanges(maxKeysPerLookup + 1)
+	if len(ranges) != 2 {
+		t.Fatalf("got %d ranges, want 2", len(ranges))
+	}
+	if ranges[0] != [2]int{0, maxKeysPerLookup} {
+		t.Errorf("ranges[0] = %v, want {0, %d}", ranges[0], maxKeysPerLookup)
+	}
+	if ranges[1] != [2]int{maxKeysPerLookup, maxKeysPerLookup + 1} {
+		t.Errorf("ranges[1] = %v, want {%d, %d}", ranges[1], maxKeysPerLookup, maxKeysPerLookup+1)
+	}
+}
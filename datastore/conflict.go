@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// EntityMetadata holds the server-assigned version and update time of an
+// entity, as returned alongside a lookup or commit. Client.GetWithMetadata
+// populates this from the entity's result proto; it can be fed into
+// Mutation.WithBaseVersion or Mutation.WithUpdateTime to detect a concurrent
+// writer without using a transaction.
+type EntityMetadata struct {
+	// Version is the current version of the entity, which increases
+	// monotonically on each write.
+	Version int64
+	// UpdateTime is the time the entity was last changed.
+	UpdateTime time.Time
+}
+
+// ConflictError reports that a Mutation's WithBaseVersion or WithUpdateTime
+// precondition did not match the entity's state in Datastore at commit time.
+// It carries the key and current version so that callers implementing
+// optimistic-concurrency read-modify-write loops can decide whether to
+// re-read and retry.
+type ConflictError struct {
+	// Key is the key of the entity whose precondition failed.
+	Key *Key
+	// CurrentVersion is the entity's actual version in Datastore at the
+	// time of the failed commit.
+	CurrentVersion int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("datastore: mutation for key %v failed its base version/update time precondition; current version is %d", e.Key, e.CurrentVersion)
+}
@@ -0,0 +1,315 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client is a client for reading and writing data in a Datastore dataset.
+type Client struct {
+	client     pb.DatastoreClient
+	projectID  string
+	databaseID string
+}
+
+// A PendingKey is the key for an entity written by a mutation. For a
+// non-transactional call such as Client.Mutate, its key is already resolved
+// by the time the call returns.
+type PendingKey struct {
+	key *Key
+}
+
+// Mutate applies one or more mutations in a non-transactional commit and
+// returns the resulting keys. If muts exceeds the Datastore service's
+// per-commit mutation-count or request-size limit, Mutate transparently
+// splits it into sub-batches and commits them in parallel; use MutateBatch to
+// control the parallelism used. Each sub-batch is a separate commit, so a
+// split call is not atomic as a whole: some sub-batches can be applied while
+// others fail.
+func (c *Client) Mutate(ctx context.Context, muts ...*Mutation) ([]*PendingKey, error) {
+	return c.MutateBatch(ctx, muts, nil)
+}
+
+// MutateBatch behaves like Mutate, but lets the caller control how an
+// oversized call is split into concurrent sub-batches via opts. A nil opts
+// behaves like Mutate.
+func (c *Client) MutateBatch(ctx context.Context, muts []*Mutation, opts *BatchOptions) ([]*PendingKey, error) {
+	// mutationProtosIndexed, not mutationProtos: both collapse duplicate
+	// deletions of the same key into one proto, so protos can be shorter
+	// than muts, but only mutationProtosIndexed also returns protoIndex.
+	// protoIndex maps each input mutation back to its proto's position,
+	// which is what keeps the commit, the returned pkeys and any returned
+	// MultiError aligned with the caller's original, unsplit muts.
+	protos, protoIndex, err := mutationProtosIndexed(muts)
+	if err != nil {
+		return nil, err
+	}
+	keysForProtos := make([]*Key, len(protos))
+	for i, m := range muts {
+		keysForProtos[protoIndex[i]] = m.key
+	}
+
+	results, err := commitInBatches(ctx, protos, false, opts, c.commitFunc(keysForProtos))
+	if err != nil {
+		if merr, ok := err.(MultiError); ok {
+			mutErr := make(MultiError, len(muts))
+			for i := range muts {
+				mutErr[i] = merr[protoIndex[i]]
+			}
+			err = mutErr
+		}
+		return nil, err
+	}
+	pkeys := make([]*PendingKey, len(muts))
+	for i, m := range muts {
+		res := results[protoIndex[i]]
+		if res == nil {
+			continue
+		}
+		k := m.key
+		if res.Key != nil {
+			k = keyFromProto(res.Key)
+		}
+		pkeys[i] = &PendingKey{key: k}
+	}
+	return pkeys, nil
+}
+
+// commitFunc returns a commitFunc that issues a single non-transactional
+// Commit RPC for a sub-batch of mutations. keys is indexed the same as the
+// unsplit proto slice passed to commitInBatches, so the sub-batch at offset
+// start corresponds to keys[start:start+len(sub)].
+func (c *Client) commitFunc(keys []*Key) commitFunc {
+	return func(ctx context.Context, start int, sub []*pb.Mutation) ([]*pb.MutationResult, error) {
+		resp, err := c.client.Commit(ctx, &pb.CommitRequest{
+			ProjectId:  c.projectID,
+			DatabaseId: c.databaseID,
+			Mode:       pb.CommitRequest_NON_TRANSACTIONAL,
+			Mutations:  sub,
+		})
+		if err != nil {
+			return nil, c.conflictError(ctx, err, keys[start:start+len(sub)])
+		}
+		return resp.MutationResults, nil
+	}
+}
+
+// conflictError translates a FAILED_PRECONDITION commit failure into a
+// *ConflictError carrying the entity's current version, which it discovers
+// with a follow-up Lookup. It only attempts the translation when the failing
+// sub-batch has exactly one mutation: with more than one, there's no way to
+// tell from the Commit error alone which mutation tripped its
+// WithBaseVersion or WithUpdateTime precondition, so the original error is
+// returned unchanged.
+func (c *Client) conflictError(ctx context.Context, err error, keys []*Key) error {
+	if len(keys) != 1 || status.Code(err) != codes.FailedPrecondition {
+		return err
+	}
+	k := keys[0]
+	resp, lookupErr := c.client.Lookup(ctx, &pb.LookupRequest{
+		ProjectId:  c.projectID,
+		DatabaseId: c.databaseID,
+		Keys:       []*pb.Key{keyToProto(k)},
+	})
+	if lookupErr != nil || len(resp.Found) == 0 {
+		return err
+	}
+	return &ConflictError{Key: k, CurrentVersion: resp.Found[0].Version}
+}
+
+// PutMulti is like calling Mutate with an upsert for each (key, src) pair: it
+// applies the same automatic chunking and parallel dispatch as Mutate. src
+// must be a slice of the same length as keys.
+func (c *Client) PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, errors.New("datastore: src must be a slice")
+	}
+	if v.Len() != len(keys) {
+		return nil, fmt.Errorf("datastore: key and src slices have different length: %d vs %d", len(keys), v.Len())
+	}
+	muts := make([]*Mutation, len(keys))
+	for i, k := range keys {
+		muts[i] = NewUpsert(k, v.Index(i).Interface())
+	}
+	pkeys, err := c.Mutate(ctx, muts...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Key, len(pkeys))
+	for i, pk := range pkeys {
+		if pk != nil {
+			out[i] = pk.key
+		}
+	}
+	return out, nil
+}
+
+// DeleteMulti is like calling Mutate with a delete for each key: it applies
+// the same automatic chunking and parallel dispatch as Mutate.
+func (c *Client) DeleteMulti(ctx context.Context, keys []*Key) error {
+	muts := make([]*Mutation, len(keys))
+	for i, k := range keys {
+		muts[i] = NewDelete(k)
+	}
+	_, err := c.Mutate(ctx, muts...)
+	return err
+}
+
+// GetMulti fetches the entities for the given keys into dst, a pointer to a
+// slice of the same length as keys whose element type implements
+// PropertyLoadSaver (for example, *[]PropertyList). If len(keys) exceeds the
+// Datastore service's per-Lookup key-count limit, GetMulti transparently
+// splits the keys across concurrent Lookup RPCs and merges the loaded
+// entities back into dst and the per-index errors into the returned
+// MultiError, both positionally aligned with keys; use GetMultiBatch to
+// control the parallelism used.
+func (c *Client) GetMulti(ctx context.Context, keys []*Key, dst interface{}) error {
+	return c.GetMultiBatch(ctx, keys, dst, nil)
+}
+
+// GetMultiBatch behaves like GetMulti, but lets the caller control how an
+// oversized call is split into concurrent sub-batches via opts. A nil opts
+// behaves like GetMulti.
+func (c *Client) GetMultiBatch(ctx context.Context, keys []*Key, dst interface{}, opts *BatchOptions) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return errors.New("datastore: dst must be a pointer to a slice")
+	}
+	sv := v.Elem()
+	if sv.Len() != len(keys) {
+		return fmt.Errorf("datastore: key and dst slices have different length: %d vs %d", len(keys), sv.Len())
+	}
+	dsts := make([]interface{}, len(keys))
+	for i := range keys {
+		dsts[i] = sv.Index(i).Addr().Interface()
+	}
+	_, err := c.getMulti(ctx, keys, dsts, opts)
+	return err
+}
+
+// GetWithMetadata fetches a single entity like Client.Get, additionally
+// returning its EntityMetadata. Callers can feed the returned version or
+// update time into Mutation.WithBaseVersion or Mutation.WithUpdateTime to
+// implement a read-modify-write loop that detects a concurrent writer
+// without a transaction.
+func (c *Client) GetWithMetadata(ctx context.Context, key *Key, dst interface{}) (*EntityMetadata, error) {
+	metas, err := c.getMulti(ctx, []*Key{key}, []interface{}{dst}, nil)
+	if err != nil {
+		if merr, ok := err.(MultiError); ok {
+			return nil, merr[0]
+		}
+		return nil, err
+	}
+	return metas[0], nil
+}
+
+// getMulti is the shared implementation behind GetMulti and GetWithMetadata.
+// It splits keys into Lookup-sized sub-batches via splitKeyRanges and issues
+// them concurrently, bounded by opts.maxParallel() (the same semaphore
+// pattern commitInBatches uses for Commit), then merges the loaded entities
+// (into dsts), their EntityMetadata, and a MultiError of per-index errors
+// back together, positionally aligned with keys.
+func (c *Client) getMulti(ctx context.Context, keys []*Key, dsts []interface{}, opts *BatchOptions) ([]*EntityMetadata, error) {
+	metas := make([]*EntityMetadata, len(keys))
+	merr := make(MultiError, len(keys))
+	var hasErr bool
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.maxParallel())
+
+	for _, r := range splitKeyRanges(len(keys)) {
+		start, end := r[0], r[1]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			found, err := c.lookupRange(ctx, keys[start:end])
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				hasErr = true
+				for i := start; i < end; i++ {
+					merr[i] = err
+				}
+				return
+			}
+			for i := start; i < end; i++ {
+				er, ok := found[keys[i].stringInternal()]
+				if !ok {
+					hasErr = true
+					merr[i] = ErrNoSuchEntity
+					continue
+				}
+				if lerr := loadEntity(dsts[i], er.Entity); lerr != nil {
+					hasErr = true
+					merr[i] = lerr
+					continue
+				}
+				meta := &EntityMetadata{Version: er.Version}
+				if er.UpdateTime != nil {
+					meta.UpdateTime = er.UpdateTime.AsTime()
+				}
+				metas[i] = meta
+			}
+		}()
+	}
+	wg.Wait()
+
+	if hasErr {
+		return metas, merr
+	}
+	return metas, nil
+}
+
+// lookupRange issues Lookup for keys, looping on the response's Deferred
+// keys (the service caps how many keys it resolves per call, so a range at
+// or near maxKeysPerLookup routinely comes back with some deferred) until
+// every key has been resolved one way or another. It returns a map from
+// key.stringInternal() to the *pb.EntityResult for keys that were Found.
+// resp.Missing is not read: any key not in Found is left out of the returned
+// map, and the caller treats any requested key missing from the map as
+// ErrNoSuchEntity. That is correct only because Deferred keys are retried
+// until none remain, so a key left out was never merely deferred.
+func (c *Client) lookupRange(ctx context.Context, keys []*Key) (map[string]*pb.EntityResult, error) {
+	found := make(map[string]*pb.EntityResult, len(keys))
+	pending := keysToProto(keys)
+	for len(pending) > 0 {
+		resp, err := c.client.Lookup(ctx, &pb.LookupRequest{
+			ProjectId:  c.projectID,
+			DatabaseId: c.databaseID,
+			Keys:       pending,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, er := range resp.Found {
+			found[keyFromProto(er.Entity.Key).stringInternal()] = er
+		}
+		pending = resp.Deferred
+	}
+	return found, nil
+}
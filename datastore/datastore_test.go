@@ -0,0 +1,419 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestClientMutateAlignsResultsWithDuplicateDeletes(t *testing.T) {
+	dupKey := &Key{Kind: "Gopher", ID: 1}
+	muts := []*Mutation{
+		NewDelete(dupKey),
+		NewDelete(dupKey), // collapsed by mutationProtos's dedup
+		NewUpsert(&Key{Kind: "Gopher", ID: 2}, &PropertyList{}),
+	}
+
+	var gotMutationCount int
+	fake := &fakeDatastoreClient{
+		commitFunc: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			gotMutationCount = len(req.Mutations)
+			res := make([]*pb.MutationResult, len(req.Mutations))
+			for i := range req.Mutations {
+				res[i] = &pb.MutationResult{}
+			}
+			return &pb.CommitResponse{MutationResults: res}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	pkeys, err := c.Mutate(context.Background(), muts...)
+	if err != nil {
+		t.Fatalf("Mutate: %v", err)
+	}
+	if gotMutationCount != 2 {
+		t.Fatalf("Commit received %d mutations, want 2 (the duplicate delete should be deduped)", gotMutationCount)
+	}
+	if len(pkeys) != len(muts) {
+		t.Fatalf("got %d pending keys, want %d (one per input mutation, not per deduped proto)", len(pkeys), len(muts))
+	}
+	for i, pk := range pkeys {
+		if pk == nil || pk.key == nil || pk.key.ID != muts[i].key.ID {
+			t.Errorf("pkeys[%d] = %v, want key aligned with muts[%d] (ID %d)", i, pk, i, muts[i].key.ID)
+		}
+	}
+}
+
+func TestClientMutateChunksLargeCalls(t *testing.T) {
+	n := maxMutationsPerCommit + 5
+	muts := make([]*Mutation, n)
+	for i := range muts {
+		muts[i] = NewUpsert(&Key{Kind: "Gopher", ID: int64(i) + 1}, &PropertyList{})
+	}
+
+	var commits int32
+	fake := &fakeDatastoreClient{
+		commitFunc: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			atomic.AddInt32(&commits, 1)
+			res := make([]*pb.MutationResult, len(req.Mutations))
+			for i := range req.Mutations {
+				res[i] = &pb.MutationResult{}
+			}
+			return &pb.CommitResponse{MutationResults: res}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	pkeys, err := c.Mutate(context.Background(), muts...)
+	if err != nil {
+		t.Fatalf("Mutate: %v", err)
+	}
+	if got := atomic.LoadInt32(&commits); got != 2 {
+		t.Errorf("Commit called %d times, want 2 (the call should have been chunked)", got)
+	}
+	if len(pkeys) != n {
+		t.Fatalf("got %d pending keys, want %d", len(pkeys), n)
+	}
+	for i, pk := range pkeys {
+		if pk == nil || pk.key == nil || pk.key.ID != muts[i].key.ID {
+			t.Errorf("pkeys[%d] = %v, want key aligned with input mutation %d (ID %d)", i, pk, i, muts[i].key.ID)
+		}
+	}
+}
+
+func TestClientDeleteMultiChunksLargeCalls(t *testing.T) {
+	n := maxMutationsPerCommit + 1
+	keys := make([]*Key, n)
+	for i := range keys {
+		keys[i] = &Key{Kind: "Gopher", ID: int64(i) + 1}
+	}
+
+	var commits int32
+	fake := &fakeDatastoreClient{
+		commitFunc: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			atomic.AddInt32(&commits, 1)
+			res := make([]*pb.MutationResult, len(req.Mutations))
+			for i := range req.Mutations {
+				res[i] = &pb.MutationResult{}
+			}
+			return &pb.CommitResponse{MutationResults: res}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatalf("DeleteMulti: %v", err)
+	}
+	if got := atomic.LoadInt32(&commits); got != 2 {
+		t.Errorf("Commit called %d times, want 2 (the call should have been chunked)", got)
+	}
+}
+
+func TestClientGetMultiChunksLargeCalls(t *testing.T) {
+	n := maxKeysPerLookup + 1
+	keys := make([]*Key, n)
+	for i := range keys {
+		keys[i] = &Key{Kind: "Gopher", ID: int64(i) + 1}
+	}
+
+	var lookups int32
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			atomic.AddInt32(&lookups, 1)
+			found := make([]*pb.EntityResult, len(req.Keys))
+			for i, k := range req.Keys {
+				found[i] = &pb.EntityResult{
+					Entity:  &pb.Entity{Key: k},
+					Version: k.Path[0].GetId(),
+				}
+			}
+			return &pb.LookupResponse{Found: found}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	dst := make([]PropertyList, n)
+	err := c.GetMulti(context.Background(), keys, &dst)
+	if err != nil {
+		t.Fatalf("GetMulti: %v", err)
+	}
+	if got := atomic.LoadInt32(&lookups); got != 2 {
+		t.Errorf("Lookup called %d times, want 2 (the call should have been chunked)", got)
+	}
+}
+
+func TestClientGetMultiFollowsDeferred(t *testing.T) {
+	keys := []*Key{
+		{Kind: "Gopher", ID: 1},
+		{Kind: "Gopher", ID: 2},
+	}
+	var lookups int32
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			call := atomic.AddInt32(&lookups, 1)
+			if call == 1 {
+				// The service only resolves the first key on the first
+				// call and defers the rest.
+				return &pb.LookupResponse{
+					Found:    []*pb.EntityResult{{Entity: &pb.Entity{Key: req.Keys[0]}, Version: 1}},
+					Deferred: req.Keys[1:],
+				}, nil
+			}
+			found := make([]*pb.EntityResult, len(req.Keys))
+			for i, k := range req.Keys {
+				found[i] = &pb.EntityResult{Entity: &pb.Entity{Key: k}, Version: 1}
+			}
+			return &pb.LookupResponse{Found: found}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	dst := make([]PropertyList, len(keys))
+	if err := c.GetMulti(context.Background(), keys, &dst); err != nil {
+		t.Fatalf("GetMulti: %v", err)
+	}
+	if got := atomic.LoadInt32(&lookups); got != 2 {
+		t.Errorf("Lookup called %d times, want 2 (it should have retried the deferred key)", got)
+	}
+}
+
+func TestClientGetMultiDeferredKeyIsNotMistakenForMissing(t *testing.T) {
+	k := &Key{Kind: "Gopher", ID: 1}
+	var lookups int32
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			if atomic.AddInt32(&lookups, 1) == 1 {
+				return &pb.LookupResponse{Deferred: req.Keys}, nil
+			}
+			return &pb.LookupResponse{
+				Found: []*pb.EntityResult{{Entity: &pb.Entity{Key: req.Keys[0]}, Version: 1}},
+			}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	if _, err := c.GetWithMetadata(context.Background(), k, &PropertyList{}); err != nil {
+		t.Fatalf("GetWithMetadata: got %v, want nil (the key was only deferred, not missing)", err)
+	}
+}
+
+func TestClientGetMultiBatchBoundsConcurrency(t *testing.T) {
+	n := 5 * maxKeysPerLookup
+	keys := make([]*Key, n)
+	for i := range keys {
+		keys[i] = &Key{Kind: "Gopher", ID: int64(i) + 1}
+	}
+
+	var inFlight, maxInFlight int32
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			cur := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				prev := atomic.LoadInt32(&maxInFlight)
+				if cur <= prev || atomic.CompareAndSwapInt32(&maxInFlight, prev, cur) {
+					break
+				}
+			}
+			found := make([]*pb.EntityResult, len(req.Keys))
+			for i, k := range req.Keys {
+				found[i] = &pb.EntityResult{Entity: &pb.Entity{Key: k}, Version: 1}
+			}
+			return &pb.LookupResponse{Found: found}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	dst := make([]PropertyList, n)
+	opts := &BatchOptions{MaxParallel: 2}
+	if err := c.GetMultiBatch(context.Background(), keys, &dst, opts); err != nil {
+		t.Fatalf("GetMultiBatch: %v", err)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > 2 {
+		t.Errorf("max concurrent Lookup calls = %d, want <= 2 (opts.MaxParallel)", got)
+	}
+}
+
+func TestClientGetMultiPerIndexErrors(t *testing.T) {
+	keys := []*Key{
+		{Kind: "Gopher", ID: 1},
+		{Kind: "Gopher", ID: 2},
+		{Kind: "Gopher", ID: 3},
+	}
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			// Only the entity for ID 2 exists.
+			var found []*pb.EntityResult
+			for _, k := range req.Keys {
+				if k.Path[0].GetId() == 2 {
+					found = append(found, &pb.EntityResult{Entity: &pb.Entity{Key: k}, Version: 1})
+				}
+			}
+			return &pb.LookupResponse{Found: found}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	dst := make([]PropertyList, len(keys))
+	err := c.GetMulti(context.Background(), keys, &dst)
+	merr, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("got error of type %T, want MultiError", err)
+	}
+	if merr[0] != ErrNoSuchEntity || merr[2] != ErrNoSuchEntity {
+		t.Errorf("merr = %v, want ErrNoSuchEntity at indexes 0 and 2", merr)
+	}
+	if merr[1] != nil {
+		t.Errorf("merr[1] = %v, want nil (ID 2 was found)", merr[1])
+	}
+}
+
+func TestClientMutateTranslatesPreconditionFailureToConflictError(t *testing.T) {
+	k := &Key{Kind: "Counter", Name: "views"}
+	fake := &fakeDatastoreClient{
+		commitFunc: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			return nil, status.Error(codes.FailedPrecondition, "base version mismatch")
+		},
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			return &pb.LookupResponse{
+				Found: []*pb.EntityResult{{
+					Entity:  &pb.Entity{Key: req.Keys[0]},
+					Version: 7,
+				}},
+			}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	_, err := c.Mutate(context.Background(), NewUpdate(k, &PropertyList{}).WithBaseVersion(3))
+	ce, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("got error of type %T, want *ConflictError", err)
+	}
+	if ce.CurrentVersion != 7 {
+		t.Errorf("CurrentVersion = %d, want 7", ce.CurrentVersion)
+	}
+	if ce.Key.stringInternal() != k.stringInternal() {
+		t.Errorf("Key = %v, want %v", ce.Key, k)
+	}
+}
+
+func TestClientMutateLeavesMultiMutationPreconditionFailureUntranslated(t *testing.T) {
+	keys := []*Key{
+		{Kind: "Counter", Name: "a"},
+		{Kind: "Counter", Name: "b"},
+	}
+	wantErr := status.Error(codes.FailedPrecondition, "base version mismatch")
+	fake := &fakeDatastoreClient{
+		commitFunc: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			return nil, wantErr
+		},
+	}
+	c := newTestClient(fake)
+
+	_, err := c.Mutate(context.Background(),
+		NewUpdate(keys[0], &PropertyList{}).WithBaseVersion(1),
+		NewUpdate(keys[1], &PropertyList{}).WithBaseVersion(1),
+	)
+	if _, ok := err.(*ConflictError); ok {
+		t.Fatalf("got *ConflictError for a multi-mutation batch, want the original ambiguous error returned unchanged")
+	}
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want the original FailedPrecondition error", err)
+	}
+}
+
+func TestClientGetWithMetadata(t *testing.T) {
+	k := &Key{Kind: "Counter", Name: "views"}
+	wantUpdate := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			return &pb.LookupResponse{
+				Found: []*pb.EntityResult{{
+					Entity:     &pb.Entity{Key: req.Keys[0]},
+					Version:    9,
+					UpdateTime: timestamppb.New(wantUpdate),
+				}},
+			}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	meta, err := c.GetWithMetadata(context.Background(), k, &PropertyList{})
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+	if meta.Version != 9 {
+		t.Errorf("Version = %d, want 9", meta.Version)
+	}
+	if !meta.UpdateTime.Equal(wantUpdate) {
+		t.Errorf("UpdateTime = %v, want %v", meta.UpdateTime, wantUpdate)
+	}
+}
+
+func TestClientGetWithMetadataNoSuchEntity(t *testing.T) {
+	k := &Key{Kind: "Counter", Name: "missing"}
+	fake := &fakeDatastoreClient{
+		lookupFunc: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			return &pb.LookupResponse{}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	if _, err := c.GetWithMetadata(context.Background(), k, &PropertyList{}); err != ErrNoSuchEntity {
+		t.Errorf("GetWithMetadata: got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestClientPutMultiChunksAndAlignsKeys(t *testing.T) {
+	n := maxMutationsPerCommit + 1
+	keys := make([]*Key, n)
+	srcs := make([]PropertyList, n)
+	for i := range keys {
+		keys[i] = &Key{Kind: "Gopher", ID: int64(i) + 1}
+	}
+
+	fake := &fakeDatastoreClient{
+		commitFunc: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			res := make([]*pb.MutationResult, len(req.Mutations))
+			for i := range req.Mutations {
+				res[i] = &pb.MutationResult{}
+			}
+			return &pb.CommitResponse{MutationResults: res}, nil
+		},
+	}
+	c := newTestClient(fake)
+
+	out, err := c.PutMulti(context.Background(), keys, srcs)
+	if err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	if len(out) != n {
+		t.Fatalf("got %d keys, want %d", len(out), n)
+	}
+	for i, k := range out {
+		if k == nil || k.ID != keys[i].ID {
+			t.Errorf("out[%d] = %v, want key with ID %d", i, k, keys[i].ID)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/grpc"
+)
+
+// fakeDatastoreClient is a pb.DatastoreClient stub for tests that only need
+// to exercise Commit and/or Lookup. Embedding the interface lets it satisfy
+// pb.DatastoreClient without implementing every RPC; calling an
+// unimplemented one panics on the nil embedded value, which is fine because
+// these tests never call them.
+type fakeDatastoreClient struct {
+	pb.DatastoreClient
+
+	commitFunc func(*pb.CommitRequest) (*pb.CommitResponse, error)
+	lookupFunc func(*pb.LookupRequest) (*pb.LookupResponse, error)
+}
+
+func (f *fakeDatastoreClient) Commit(ctx context.Context, req *pb.CommitRequest, _ ...grpc.CallOption) (*pb.CommitResponse, error) {
+	return f.commitFunc(req)
+}
+
+func (f *fakeDatastoreClient) Lookup(ctx context.Context, req *pb.LookupRequest, _ ...grpc.CallOption) (*pb.LookupResponse, error) {
+	return f.lookupFunc(req)
+}
+
+func newTestClient(f *fakeDatastoreClient) *Client {
+	return &Client{client: f, projectID: "test-project"}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"strconv"
+	"strings"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+)
+
+// A Key represents the datastore key for a stored entity, and is immutable.
+type Key struct {
+	// Kind cannot be empty.
+	Kind string
+	// Either Name or ID must be zero for the Key to be valid. If both are
+	// zero, the Key is incomplete and is only valid as an argument to Put.
+	Name string
+	ID   int64
+	// Parent is the Key of the entity's parent, or nil if there is no
+	// parent.
+	Parent *Key
+	// Namespace provides the ability to partition your data for multiple
+	// tenants. In most cases, it is not necessary to specify a namespace.
+	Namespace string
+}
+
+// valid returns whether the key is valid.
+func (k *Key) valid() bool {
+	if k == nil {
+		return false
+	}
+	for ; k != nil; k = k.Parent {
+		if k.Kind == "" {
+			return false
+		}
+		if k.Name != "" && k.ID != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Incomplete returns whether the key does not refer to a stored entity.
+func (k *Key) Incomplete() bool {
+	return k.Name == "" && k.ID == 0
+}
+
+// stringInternal returns a string representation of the key, used to dedup
+// deletions in mutationProtos and to match up Lookup results with the keys
+// that were requested.
+func (k *Key) stringInternal() string {
+	var b strings.Builder
+	if k.Parent != nil {
+		b.WriteString(k.Parent.stringInternal())
+		b.WriteByte('/')
+	}
+	b.WriteString(k.Kind)
+	b.WriteByte(',')
+	if k.Name != "" {
+		b.WriteString(k.Name)
+	} else {
+		b.WriteString(strconv.FormatInt(k.ID, 10))
+	}
+	if k.Namespace != "" {
+		b.WriteByte('@')
+		b.WriteString(k.Namespace)
+	}
+	return b.String()
+}
+
+// String returns a string representation of the key, for debugging and error
+// messages. It is not guaranteed to be unique across namespaces.
+func (k *Key) String() string {
+	if k == nil {
+		return ""
+	}
+	return k.stringInternal()
+}
+
+// keyToProto converts a Key to a protobuf Key, walking up through k.Parent to
+// build the full ancestor path.
+func keyToProto(k *Key) *pb.Key {
+	if k == nil {
+		return nil
+	}
+	var path []*pb.Key_PathElement
+	namespace := k.Namespace
+	for cur := k; cur != nil; cur = cur.Parent {
+		el := &pb.Key_PathElement{Kind: cur.Kind}
+		if cur.Name != "" {
+			el.IdType = &pb.Key_PathElement_Name{Name: cur.Name}
+		} else if cur.ID != 0 {
+			el.IdType = &pb.Key_PathElement_Id{Id: cur.ID}
+		}
+		path = append([]*pb.Key_PathElement{el}, path...)
+	}
+	return &pb.Key{
+		PartitionId: &pb.PartitionId{NamespaceId: namespace},
+		Path:        path,
+	}
+}
+
+// keysToProto converts a slice of Keys to their protobuf representation.
+func keysToProto(keys []*Key) []*pb.Key {
+	protos := make([]*pb.Key, len(keys))
+	for i, k := range keys {
+		protos[i] = keyToProto(k)
+	}
+	return protos
+}
+
+// keyFromProto converts a protobuf Key back to a Key, the inverse of
+// keyToProto. It's used to read back the completed key the service assigns
+// an inserted entity, and the key of an entity found by Lookup.
+func keyFromProto(p *pb.Key) *Key {
+	if p == nil || len(p.Path) == 0 {
+		return nil
+	}
+	var k *Key
+	for _, el := range p.Path {
+		k = &Key{Kind: el.Kind, Parent: k}
+		switch id := el.IdType.(type) {
+		case *pb.Key_PathElement_Name:
+			k.Name = id.Name
+		case *pb.Key_PathElement_Id:
+			k.ID = id.Id
+		}
+	}
+	if p.PartitionId != nil {
+		k.Namespace = p.PartitionId.NamespaceId
+	}
+	return k
+}
@@ -17,8 +17,10 @@ package datastore
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // A Mutation represents a change to a Datastore entity.
@@ -54,6 +56,10 @@ func (m *Mutation) WithTransforms(transforms ...PropertyTransform) *Mutation {
 	}
 
 	for _, transform := range transforms {
+		if transform.err != nil {
+			m.err = transform.err
+			return m
+		}
 		if transform.pb == nil {
 			m.err = errors.New("datastore: WithTransforms called with an uninitialized PropertyTransform")
 			return m
@@ -66,6 +72,52 @@ func (m *Mutation) WithTransforms(transforms ...PropertyTransform) *Mutation {
 	return m
 }
 
+// WithBaseVersion sets a precondition on the mutation that causes it to fail
+// if the targeted entity's current version in Datastore is not v. The
+// failure is reported as a *ConflictError only when the mutation was
+// committed alone in its sub-batch and a follow-up Lookup finds the entity;
+// otherwise the commit's FailedPrecondition error is returned unchanged, as
+// the error does not identify which mutation failed. It can be used to
+// implement optimistic-concurrency
+// read-modify-write loops without a full transaction: read an entity, note
+// its version (see Client.GetWithMetadata), and write it back conditioned on
+// that version still being current.
+//
+// WithBaseVersion and WithUpdateTime are mutually exclusive; the most
+// recently called one wins.
+func (m *Mutation) WithBaseVersion(v int64) *Mutation {
+	if m.err != nil {
+		return m
+	}
+	if m.mut == nil {
+		m.err = errors.New("datastore: WithBaseVersion called on uninitialized mutation")
+		return m
+	}
+	m.mut.ConflictDetectionStrategy = &pb.Mutation_BaseVersion{BaseVersion: v}
+	return m
+}
+
+// WithUpdateTime sets a precondition on the mutation that causes it to fail
+// if the targeted entity's current update time in Datastore is not t. As
+// with WithBaseVersion, the failure is a *ConflictError only when the
+// mutation was committed alone in its sub-batch and a follow-up Lookup finds
+// the entity. Like WithBaseVersion, this supports optimistic concurrency
+// without a transaction.
+//
+// WithBaseVersion and WithUpdateTime are mutually exclusive; the most
+// recently called one wins.
+func (m *Mutation) WithUpdateTime(t time.Time) *Mutation {
+	if m.err != nil {
+		return m
+	}
+	if m.mut == nil {
+		m.err = errors.New("datastore: WithUpdateTime called on uninitialized mutation")
+		return m
+	}
+	m.mut.ConflictDetectionStrategy = &pb.Mutation_UpdateTime{UpdateTime: timestamppb.New(t)}
+	return m
+}
+
 // setMutationProtoPropertyMaskForTransforms sets the property mask on the
 // given mutation to match the client-provided property names in the
 // mutation. This is only done when transforms are present. Otherwise, no
@@ -183,6 +235,20 @@ func NewDelete(k *Key) *Mutation {
 }
 
 func mutationProtos(muts []*Mutation) ([]*pb.Mutation, error) {
+	protos, _, err := mutationProtosIndexed(muts)
+	return protos, err
+}
+
+// mutationProtosIndexed is like mutationProtos, but additionally returns
+// protoIndex, a slice of len(muts) mapping each input mutation to its index
+// in the returned protos: protos[protoIndex[i]] is the proto that resulted
+// from muts[i]. Since duplicate deletions of the same key are collapsed into
+// a single proto, protoIndex is not simply the identity mapping, and more
+// than one mutation index can map to the same proto index. Callers that need
+// to report a per-mutation result or error (rather than a per-proto one)
+// against the caller's original, unsplit input must go through protoIndex to
+// stay positionally aligned with muts.
+func mutationProtosIndexed(muts []*Mutation) (protos []*pb.Mutation, protoIndex []int, err error) {
 	// If any of the mutations have errors, collect and return them.
 	var merr MultiError
 	for i, m := range muts {
@@ -194,21 +260,23 @@ func mutationProtos(muts []*Mutation) ([]*pb.Mutation, error) {
 		}
 	}
 	if merr != nil {
-		return nil, merr
+		return nil, nil, merr
 	}
 
-	var protos []*pb.Mutation
+	protoIndex = make([]int, len(muts))
 	// Collect protos. Remove duplicate deletions (see deleteMutations).
-	seen := map[string]bool{}
-	for _, m := range muts {
+	seen := map[string]int{}
+	for i, m := range muts {
 		if m.isDelete() {
 			ks := m.key.stringInternal()
-			if seen[ks] {
+			if j, ok := seen[ks]; ok {
+				protoIndex[i] = j
 				continue
 			}
-			seen[ks] = true
+			seen[ks] = len(protos)
 		}
+		protoIndex[i] = len(protos)
 		protos = append(protos, m.mut)
 	}
-	return protos, nil
+	return protos, protoIndex, nil
 }
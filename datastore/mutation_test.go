@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+)
+
+func TestMutationWithBaseVersion(t *testing.T) {
+	k := &Key{Kind: "Gopher", ID: 1}
+	m := NewUpdate(k, &PropertyList{}).WithBaseVersion(42)
+	if m.err != nil {
+		t.Fatalf("WithBaseVersion set an error: %v", m.err)
+	}
+	bv, ok := m.mut.ConflictDetectionStrategy.(*pb.Mutation_BaseVersion)
+	if !ok {
+		t.Fatalf("ConflictDetectionStrategy = %T, want *pb.Mutation_BaseVersion", m.mut.ConflictDetectionStrategy)
+	}
+	if bv.BaseVersion != 42 {
+		t.Errorf("BaseVersion = %d, want 42", bv.BaseVersion)
+	}
+}
+
+func TestMutationWithUpdateTime(t *testing.T) {
+	k := &Key{Kind: "Gopher", ID: 1}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := NewUpdate(k, &PropertyList{}).WithUpdateTime(want)
+	if m.err != nil {
+		t.Fatalf("WithUpdateTime set an error: %v", m.err)
+	}
+	ut, ok := m.mut.ConflictDetectionStrategy.(*pb.Mutation_UpdateTime)
+	if !ok {
+		t.Fatalf("ConflictDetectionStrategy = %T, want *pb.Mutation_UpdateTime", m.mut.ConflictDetectionStrategy)
+	}
+	if !ut.UpdateTime.AsTime().Equal(want) {
+		t.Errorf("UpdateTime = %v, want %v", ut.UpdateTime.AsTime(), want)
+	}
+}
+
+func TestMutationWithBaseVersionOnUninitializedMutation(t *testing.T) {
+	m := (&Mutation{}).WithBaseVersion(1)
+	if m.err == nil {
+		t.Fatal("WithBaseVersion on an uninitialized Mutation: got nil error, want one")
+	}
+}
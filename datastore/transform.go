@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+)
+
+// PropertyTransform represents a transformation of a property on an entity,
+// applied by the server as part of a Mutation. Construct one with NewIncrement,
+// NewMaximum, NewMinimum, NewAppendMissingElements, NewRemoveAllFromArray, or
+// NewServerTimestamp, and pass it to Mutation.WithTransforms.
+type PropertyTransform struct {
+	pb  *pb.PropertyTransform
+	err error
+}
+
+// valuesToProto converts a slice of Go values into a Datastore ArrayValue,
+// using the same conversion rules as saving an entity property.
+func valuesToProto(values []interface{}) (*pb.ArrayValue, error) {
+	vs := make([]*pb.Value, 0, len(values))
+	for _, v := range values {
+		pv, err := interfaceToProto(v, false)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, pv)
+	}
+	return &pb.ArrayValue{Values: vs}, nil
+}
+
+// NewIncrement creates a PropertyTransform that atomically adds delta to the
+// property identified by path on the server, and sets the property to the
+// resulting value. If the property does not exist, it is set to delta. If
+// delta and the property's current value are both integers, the result is an
+// integer; if either is a floating point number, the result is a floating
+// point number.
+func NewIncrement(path string, delta interface{}) PropertyTransform {
+	v, err := interfaceToProto(delta, false)
+	if err != nil {
+		return PropertyTransform{err: err}
+	}
+	return PropertyTransform{
+		pb: &pb.PropertyTransform{
+			Property:      path,
+			TransformType: &pb.PropertyTransform_Increment{Increment: v},
+		},
+	}
+}
+
+// NewMaximum creates a PropertyTransform that sets the property identified by
+// path to the larger of its current value and value. If the property is not
+// set, the transform result is value. If either value is a double, both
+// values are interpreted as doubles for the comparison.
+func NewMaximum(path string, value interface{}) PropertyTransform {
+	v, err := interfaceToProto(value, false)
+	if err != nil {
+		return PropertyTransform{err: err}
+	}
+	return PropertyTransform{
+		pb: &pb.PropertyTransform{
+			Property:      path,
+			TransformType: &pb.PropertyTransform_Maximum{Maximum: v},
+		},
+	}
+}
+
+// NewMinimum creates a PropertyTransform that sets the property identified by
+// path to the smaller of its current value and value. If the property is not
+// set, the transform result is value. If either value is a double, both
+// values are interpreted as doubles for the comparison.
+func NewMinimum(path string, value interface{}) PropertyTransform {
+	v, err := interfaceToProto(value, false)
+	if err != nil {
+		return PropertyTransform{err: err}
+	}
+	return PropertyTransform{
+		pb: &pb.PropertyTransform{
+			Property:      path,
+			TransformType: &pb.PropertyTransform_Minimum{Minimum: v},
+		},
+	}
+}
+
+// NewAppendMissingElements creates a PropertyTransform that appends the given
+// values to the array property identified by path, but only those values
+// that are not already present. If the property is not an array, or does not
+// exist, it is set to an array containing the deduplicated values.
+func NewAppendMissingElements(path string, values ...interface{}) PropertyTransform {
+	av, err := valuesToProto(values)
+	if err != nil {
+		return PropertyTransform{err: err}
+	}
+	return PropertyTransform{
+		pb: &pb.PropertyTransform{
+			Property:      path,
+			TransformType: &pb.PropertyTransform_AppendMissingElements{AppendMissingElements: av},
+		},
+	}
+}
+
+// NewRemoveAllFromArray creates a PropertyTransform that removes all of the
+// given values from the array property identified by path. If the property
+// is not an array, or does not exist, it is set to an empty array.
+func NewRemoveAllFromArray(path string, values ...interface{}) PropertyTransform {
+	av, err := valuesToProto(values)
+	if err != nil {
+		return PropertyTransform{err: err}
+	}
+	return PropertyTransform{
+		pb: &pb.PropertyTransform{
+			Property:      path,
+			TransformType: &pb.PropertyTransform_RemoveAllFromArray{RemoveAllFromArray: av},
+		},
+	}
+}
+
+// NewServerTimestamp creates a PropertyTransform that sets the property
+// identified by path to the time the server processes the mutation, expressed
+// in microsecond precision. This is the "interesting case" for transforms: it
+// lets a caller stamp an update time without reading the entity first.
+func NewServerTimestamp(path string) PropertyTransform {
+	return PropertyTransform{
+		pb: &pb.PropertyTransform{
+			Property:      path,
+			TransformType: &pb.PropertyTransform_SetToServerValue{SetToServerValue: pb.PropertyTransform_REQUEST_TIME},
+		},
+	}
+}
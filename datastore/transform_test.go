@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+)
+
+func TestNewIncrement(t *testing.T) {
+	tr := NewIncrement("views", int64(1))
+	if tr.err != nil {
+		t.Fatalf("NewIncrement: %v", tr.err)
+	}
+	inc, ok := tr.pb.TransformType.(*pb.PropertyTransform_Increment)
+	if !ok {
+		t.Fatalf("TransformType = %T, want *pb.PropertyTransform_Increment", tr.pb.TransformType)
+	}
+	if got := inc.Increment.GetIntegerValue(); got != 1 {
+		t.Errorf("Increment = %d, want 1", got)
+	}
+	if tr.pb.Property != "views" {
+		t.Errorf("Property = %q, want %q", tr.pb.Property, "views")
+	}
+}
+
+func TestNewServerTimestamp(t *testing.T) {
+	tr := NewServerTimestamp("updatedAt")
+	sv, ok := tr.pb.TransformType.(*pb.PropertyTransform_SetToServerValue)
+	if !ok {
+		t.Fatalf("TransformType = %T, want *pb.PropertyTransform_SetToServerValue", tr.pb.TransformType)
+	}
+	if sv.SetToServerValue != pb.PropertyTransform_REQUEST_TIME {
+		t.Errorf("SetToServerValue = %v, want REQUEST_TIME", sv.SetToServerValue)
+	}
+}
+
+func TestNewAppendMissingElements(t *testing.T) {
+	tr := NewAppendMissingElements("tags", "a", "b")
+	av, ok := tr.pb.TransformType.(*pb.PropertyTransform_AppendMissingElements)
+	if !ok {
+		t.Fatalf("TransformType = %T, want *pb.PropertyTransform_AppendMissingElements", tr.pb.TransformType)
+	}
+	if len(av.AppendMissingElements.Values) != 2 {
+		t.Fatalf("got %d values, want 2", len(av.AppendMissingElements.Values))
+	}
+}
+
+func TestWithTransformsSetsPropertyMask(t *testing.T) {
+	k := &Key{Kind: "Gopher", ID: 1}
+	m := NewUpdate(k, &PropertyList{}).WithTransforms(NewIncrement("views", 1), NewServerTimestamp("updatedAt"))
+	if m.err != nil {
+		t.Fatalf("WithTransforms: %v", m.err)
+	}
+	if len(m.mut.PropertyTransforms) != 2 {
+		t.Fatalf("got %d transforms, want 2", len(m.mut.PropertyTransforms))
+	}
+	if m.mut.PropertyMask == nil {
+		t.Fatal("PropertyMask is nil, want a mask restricting writes to client-provided properties")
+	}
+}
+
+func TestWithTransformsPropagatesConstructorError(t *testing.T) {
+	k := &Key{Kind: "Gopher", ID: 1}
+	// channels can't be converted to a Datastore value, so interfaceToProto
+	// (via NewIncrement) should fail and that error should surface here.
+	bad := NewIncrement("views", make(chan int))
+	m := NewUpdate(k, &PropertyList{}).WithTransforms(bad)
+	if m.err == nil {
+		t.Fatal("WithTransforms with an invalid transform value: got nil error, want one")
+	}
+}